@@ -4,16 +4,25 @@ package monoimporter
 
 import (
 	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"go/ast"
 	"go/build"
+	"go/parser"
 	"go/token"
 	"go/types"
 	"io"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/u-root/gobusybox/src/pkg/bb/bbinternal"
 	"golang.org/x/tools/go/gcexportdata"
@@ -181,6 +190,432 @@ func (a mappedArchives) findAndOpen(pkg string) io.ReadCloser {
 	return nil
 }
 
+// manifestEntry describes a single dependency in a JSON manifest produced by
+// a build system's Go rules (e.g. a Bazel aspect modeled on rules_go's
+// go_path rule).
+type manifestEntry struct {
+	// ImportPath is the Go import path this entry provides, e.g. "io" or
+	// "github.com/u-root/u-root/pkg/uio".
+	ImportPath string `json:"importPath"`
+
+	// ArchivePath is the path to the compiled .a/.x archive (export data)
+	// for ImportPath.
+	ArchivePath string `json:"archivePath"`
+
+	// Kind is either "stdlib" or "dep".
+	Kind string `json:"kind"`
+
+	// GOOS and GOARCH restrict this entry to a specific Go environment.
+	// Empty means the entry applies regardless of GOOS/GOARCH, which is
+	// normal for "dep" entries and only meaningful for "stdlib" entries
+	// when a manifest covers more than one target.
+	GOOS   string `json:"goos"`
+	GOARCH string `json:"goarch"`
+
+	// Cgo indicates whether ArchivePath was built with cgo enabled. A nil
+	// value means the entry applies regardless of cgo setting, which is
+	// normal for "dep" entries synthesized from constructors that never
+	// had cgo information to begin with (e.g. NewFromZips, New).
+	Cgo *bool `json:"cgo,omitempty"`
+}
+
+// manifest is the top-level JSON document read by NewFromManifest.
+type manifest struct {
+	Packages []manifestEntry `json:"packages"`
+}
+
+// manifestFinder is a purely map-based finder: every import path is resolved
+// by an exact lookup with no suffix guessing, because the manifest that
+// produced it already did the work of matching archives to import paths.
+type manifestFinder struct {
+	// pkgs maps import path -> archive file path, already filtered down to
+	// entries matching the requested build.Context and cgo setting.
+	pkgs map[string]string
+}
+
+func newManifestFinder(ctxt build.Context, entries []manifestEntry) *manifestFinder {
+	m := &manifestFinder{pkgs: make(map[string]string, len(entries))}
+	for _, e := range entries {
+		// Kind doesn't affect matching -- every entry is matched by its
+		// exact ImportPath regardless of whether it's stdlib or a dep --
+		// but validate it so a manifest author's typo is caught here
+		// instead of silently producing an unreachable entry.
+		switch e.Kind {
+		case "", "stdlib", "dep":
+		default:
+			log.Printf("manifest: entry for %q has unrecognized kind %q, want \"stdlib\" or \"dep\"", e.ImportPath, e.Kind)
+		}
+		if e.GOOS != "" && e.GOOS != ctxt.GOOS {
+			continue
+		}
+		if e.GOARCH != "" && e.GOARCH != ctxt.GOARCH {
+			continue
+		}
+		if e.Cgo != nil && *e.Cgo != ctxt.CgoEnabled {
+			continue
+		}
+		m.pkgs[e.ImportPath] = e.ArchivePath
+	}
+	return m
+}
+
+func (m *manifestFinder) findAndOpen(pkg string) io.ReadCloser {
+	filename, ok := m.pkgs[pkg]
+	if !ok {
+		return nil
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	return f
+}
+
+// goPathZip is a finder backed by a zip archive in rules_go's go_path
+// layout: Go sources under "src/<importPath>/*.go" and, optionally,
+// precompiled export data under "pkg/<goos_goarch>/<importPath>.a". This
+// lets bb consume the output of a single go_path target instead of one
+// archive path per go_library.
+type goPathZip struct {
+	ctxt build.Context
+
+	// archives maps import path -> precompiled archive zip entry, when
+	// go_path was built with compilation_mode that produces them.
+	archives map[string]*zip.File
+
+	// sources maps import path -> the .go file entries under its
+	// src/<importPath>/ directory, used when no precompiled archive is
+	// present.
+	sources map[string][]*zip.File
+
+	// importer is the owning Importer, used to recursively resolve the
+	// imports of on-the-fly compiled packages and to share its fset.
+	importer *Importer
+}
+
+func newGoPathZip(ctxt build.Context) *goPathZip {
+	return &goPathZip{
+		ctxt:     ctxt,
+		archives: make(map[string]*zip.File),
+		sources:  make(map[string][]*zip.File),
+	}
+}
+
+// index adds the contents of a go_path zip to g.
+func (g *goPathZip) index(zr *zip.Reader) {
+	archivePrefix := fmt.Sprintf("pkg/%s/", goEnvDir(g.ctxt))
+	for _, f := range zr.File {
+		switch {
+		case strings.HasPrefix(f.Name, "src/") && strings.HasSuffix(f.Name, ".go"):
+			importPath := strings.TrimSuffix(strings.TrimPrefix(f.Name, "src/"), "/"+filepath.Base(f.Name))
+			g.sources[importPath] = append(g.sources[importPath], f)
+		case strings.HasPrefix(f.Name, archivePrefix) && strings.HasSuffix(f.Name, ".a"):
+			importPath := strings.TrimSuffix(strings.TrimPrefix(f.Name, archivePrefix), ".a")
+			g.archives[importPath] = f
+		}
+	}
+}
+
+func (g *goPathZip) findAndOpen(pkg string) io.ReadCloser {
+	if f, ok := g.archives[pkg]; ok {
+		rc, err := f.Open()
+		if err != nil {
+			return nil
+		}
+		return rc
+	}
+	files, ok := g.sources[pkg]
+	if !ok {
+		return nil
+	}
+	data, err := g.compileFromSource(pkg, files)
+	if err != nil {
+		log.Printf("go_path zip: compiling %q from source: %v", pkg, err)
+		return nil
+	}
+	return rawExportData{Reader: bytes.NewReader(data)}
+}
+
+// compileFromSource parses and type-checks files (the .go files found under
+// pkg's src/ directory in the zip) and re-serializes the resulting
+// *types.Package as export data, so callers can treat it exactly like a
+// precompiled archive.
+func (g *goPathZip) compileFromSource(pkg string, files []*zip.File) ([]byte, error) {
+	fset := g.importer.fset
+
+	var astFiles []*ast.File
+	for _, f := range files {
+		if strings.HasSuffix(f.Name, "_test.go") {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		src, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		astFile, err := parser.ParseFile(fset, f.Name, src, 0)
+		if err != nil {
+			return nil, err
+		}
+		astFiles = append(astFiles, astFile)
+	}
+	if len(astFiles) == 0 {
+		return nil, fmt.Errorf("no buildable Go files for %q", pkg)
+	}
+
+	conf := types.Config{
+		Importer:         g.importer,
+		IgnoreFuncBodies: true,
+	}
+	tpkg, err := conf.Check(pkg, fset, astFiles, nil)
+	if err != nil {
+		return nil, fmt.Errorf("type checking failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := gcexportdata.Write(&buf, fset, tpkg); err != nil {
+		return nil, fmt.Errorf("writing export data failed: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// rawExportData marks a finder result as already being gcexportdata.Write's
+// output, e.g. from compiling a package from source on the fly, rather than
+// a real compiler-produced archive. It must be decoded with gcexportdata.Read
+// directly: unlike a real archive, it has no object-file header for
+// gcexportdata.NewReader to scan past, so feeding it to NewReader fails with
+// "not a Go object file".
+type rawExportData struct {
+	*bytes.Reader
+}
+
+func (rawExportData) Close() error { return nil }
+
+// exportCache is a size-bounded, on-disk LRU cache of decoded export data,
+// keyed on (importPath, archive digest, Go version, GOOS/GOARCH) so that
+// repeated bb invocations -- e.g. one per Bazel action, each its own
+// process -- don't re-decode the same stdlib and dependency export data
+// every time. The on-disk manifest is the source of truth: every lookup and
+// store re-reads it under an interprocess lock rather than trusting an
+// in-memory copy, so concurrent bb processes sharing a cache dir neither
+// clobber each other's updates nor operate on stale recency data.
+type exportCache struct {
+	dir        string
+	maxEntries int
+}
+
+// cacheManifest is persisted as dir/manifest.json so entries can be found
+// and cleaned up deterministically across processes.
+type cacheManifest struct {
+	Entries []*cacheEntry `json:"entries"`
+}
+
+type cacheEntry struct {
+	Key      string `json:"key"`
+	Blob     string `json:"blob"`
+	LastUsed int64  `json:"lastUsed"`
+}
+
+// defaultCacheMaxEntries bounds the cache to a reasonable number of decoded
+// packages; each entry is typically a few KB to a few hundred KB.
+const defaultCacheMaxEntries = 2048
+
+func newExportCache(dir string) (*exportCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("could not create cache dir %q: %v", dir, err)
+	}
+	return &exportCache{dir: dir, maxEntries: defaultCacheMaxEntries}, nil
+}
+
+func (c *exportCache) manifestPath() string {
+	return filepath.Join(c.dir, "manifest.json")
+}
+
+func (c *exportCache) lockPath() string {
+	return filepath.Join(c.dir, "manifest.lock")
+}
+
+func cacheKey(importPath, digest, goos, goarch string) string {
+	return fmt.Sprintf("%s|%s|%s|%s_%s", importPath, digest, runtime.Version(), goos, goarch)
+}
+
+// lockStaleAfter bounds how long we'll honor another process's manifest
+// lock before assuming it crashed without cleaning up and stealing it. This
+// keeps a dead holder from wedging every future bb invocation that shares
+// the cache dir.
+const lockStaleAfter = 10 * time.Second
+
+// withManifestLocked takes an interprocess lock on the cache's manifest
+// file, re-reads the manifest fresh from disk (another process may have
+// changed it since we last looked), and lets fn mutate it in place. If fn
+// reports a change, the manifest is written back atomically (temp file +
+// rename) before the lock is released.
+func (c *exportCache) withManifestLocked(fn func(m *cacheManifest) (changed bool)) error {
+	unlock, err := c.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	var m cacheManifest
+	if data, err := os.ReadFile(c.manifestPath()); err == nil {
+		if err := json.Unmarshal(data, &m); err != nil {
+			log.Printf("export cache: ignoring corrupt manifest %q: %v", c.manifestPath(), err)
+			m = cacheManifest{}
+		}
+	}
+
+	if !fn(&m) {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(&m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("could not marshal manifest: %v", err)
+	}
+	tmp := c.manifestPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return fmt.Errorf("could not write manifest: %v", err)
+	}
+	return os.Rename(tmp, c.manifestPath())
+}
+
+// lock acquires an exclusive, advisory lock on the cache dir shared by
+// every process pointed at it, via a lock file created with O_EXCL. The
+// returned func releases it.
+func (c *exportCache) lock() (func(), error) {
+	lockPath := c.lockPath()
+	deadline := time.Now().Add(lockStaleAfter)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(lockPath) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("could not create lock %q: %v", lockPath, err)
+		}
+		if time.Now().After(deadline) {
+			// The previous holder likely crashed without cleaning up;
+			// steal the lock rather than wedging every bb invocation
+			// that shares this cache dir from here on.
+			os.Remove(lockPath)
+			continue
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// lookup returns the stashed export data blob for key, if present, and
+// persists its updated recency so eviction in store reflects real
+// cross-process usage.
+func (c *exportCache) lookup(key string) ([]byte, bool) {
+	var blob string
+	found := false
+	err := c.withManifestLocked(func(m *cacheManifest) bool {
+		for _, e := range m.Entries {
+			if e.Key == key {
+				blob = e.Blob
+				e.LastUsed = time.Now().UnixNano()
+				found = true
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		log.Printf("export cache: lookup of %q failed: %v", key, err)
+		return nil, false
+	}
+	if !found {
+		return nil, false
+	}
+	data, err := os.ReadFile(filepath.Join(c.dir, blob))
+	if err != nil {
+		return nil, false
+	}
+	return data, true
+}
+
+// store writes data as a new cache entry for key, evicting the
+// least-recently-used entries if the cache has grown past maxEntries.
+func (c *exportCache) store(key string, data []byte) {
+	blob := fmt.Sprintf("%x.gcexportdata", sha256.Sum256([]byte(key)))
+	if err := os.WriteFile(filepath.Join(c.dir, blob), data, 0o644); err != nil {
+		log.Printf("export cache: could not write %q: %v", blob, err)
+		return
+	}
+
+	var evicted []string
+	err := c.withManifestLocked(func(m *cacheManifest) bool {
+		// Another process may have cached this key while we were
+		// decoding it ourselves; don't duplicate the entry.
+		for _, e := range m.Entries {
+			if e.Key == key {
+				e.LastUsed = time.Now().UnixNano()
+				return true
+			}
+		}
+		m.Entries = append(m.Entries, &cacheEntry{
+			Key:      key,
+			Blob:     blob,
+			LastUsed: time.Now().UnixNano(),
+		})
+		for len(m.Entries) > c.maxEntries {
+			oldest := 0
+			for i, e := range m.Entries {
+				if e.LastUsed < m.Entries[oldest].LastUsed {
+					oldest = i
+				}
+			}
+			evicted = append(evicted, m.Entries[oldest].Blob)
+			m.Entries = append(m.Entries[:oldest], m.Entries[oldest+1:]...)
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("export cache: could not update manifest for %q: %v", key, err)
+		return
+	}
+	for _, b := range evicted {
+		os.Remove(filepath.Join(c.dir, b))
+	}
+}
+
+// ImporterOption configures optional Importer behavior shared across all
+// constructors.
+type ImporterOption func(*Importer)
+
+// WithCacheDir enables a persistent on-disk cache of decoded export data
+// under dir. It is safe to point multiple Importers, even from separate
+// processes, at the same dir.
+func WithCacheDir(dir string) ImporterOption {
+	return func(i *Importer) {
+		c, err := newExportCache(dir)
+		if err != nil {
+			log.Printf("monoimporter: %v; continuing without a cache", err)
+			return
+		}
+		i.cache = c
+	}
+}
+
+// WithSourceFallback enables resolving an import path from Go source when no
+// finder has an archive for it, which otherwise fails hard when a user
+// hand-invokes bb outside its usual build system or forgets a deps entry.
+// roots are searched GOPATH-style (root/src/<importPath>) and
+// module-cache-style (root/<importPath>) for the package's source
+// directory.
+func WithSourceFallback(roots ...string) ImporterOption {
+	return func(i *Importer) {
+		i.sourceRoots = roots
+	}
+}
+
 // Importer implements a go/types.Importer for bazel-like monorepo build
 // systems for Go packages.
 //
@@ -191,16 +626,46 @@ func (a mappedArchives) findAndOpen(pkg string) io.ReadCloser {
 type Importer struct {
 	fset *token.FileSet
 
+	// mu protects imports and inflight against concurrent callers of
+	// Import, e.g. from LoadMany's worker pool.
+	mu sync.Mutex
+
 	// imports is a cache of imported packages.
 	imports map[string]*types.Package
 
-	mapped   *mappedArchives
+	// inflight deduplicates concurrent Import calls for the same import
+	// path, so export data for e.g. "io" is only decoded once no matter
+	// how many goroutines request it at the same time.
+	inflight map[string]*importCall
+
 	unmapped *unmappedArchives
 	stdlib   *stdlibArchives
 
 	// stdlibZip is an archive reader for standard library package object
 	// files.
 	stdlibZip *zipReader
+
+	// manifest is a map-based finder built from a JSON manifest. When
+	// present, it is tried before the legacy finders above, since it
+	// never guesses: every import path in it is an exact match.
+	manifest *manifestFinder
+
+	// goPathZip indexes a rules_go go_path zip archive, when one was
+	// supplied via NewFromGoPathZips.
+	goPathZip *goPathZip
+
+	// ctxt is the build context this Importer was constructed with, kept
+	// around for cache keys.
+	ctxt build.Context
+
+	// cache is a persistent decoded-export-data cache, enabled via
+	// WithCacheDir.
+	cache *exportCache
+
+	// sourceRoots holds GOPATH- or module-cache-style roots to search for
+	// an import path's source directory when no finder has an archive
+	// for it, enabled via WithSourceFallback.
+	sourceRoots []string
 }
 
 // NewFromZips returns a new monorepo importer, using the build context to pick
@@ -209,7 +674,7 @@ type Importer struct {
 // zips refers to zip file paths with Go standard library object files.
 //
 // archives refers to directories in which to find compiled Go package object files.
-func NewFromZips(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, stdlibZips []string) (*Importer, error) {
+func NewFromZips(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, stdlibZips []string, opts ...ImporterOption) (*Importer, error) {
 	// Some architectures have extra stuff after the GOARCH in the stdlib filename.
 	ctxtWithWildcard := ctxt
 	ctxtWithWildcard.GOARCH += "*"
@@ -230,15 +695,21 @@ func NewFromZips(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, st
 		}
 	}
 
-	ma := &mappedArchives{
-		pkgs: make(map[string]string),
-	}
+	// mappedArchs is just a flattened goImportPath:goArchiveFilePath
+	// manifest already; synthesize the equivalent manifest entries so the
+	// mapped lookup goes through the same map-based path as
+	// NewFromManifest.
+	var entries []manifestEntry
 	for _, archive := range mappedArchs {
 		nameAndFile := strings.Split(archive, ":")
 		if len(nameAndFile) != 2 {
 			return nil, fmt.Errorf("archive %q is not goImportPath:goArchiveFilePath", nameAndFile)
 		}
-		ma.pkgs[nameAndFile[0]] = nameAndFile[1]
+		entries = append(entries, manifestEntry{
+			ImportPath:  nameAndFile[0],
+			ArchivePath: nameAndFile[1],
+			Kind:        "dep",
+		})
 	}
 	sa := &stdlibArchives{
 		ctxt:  ctxt,
@@ -246,41 +717,157 @@ func NewFromZips(ctxt build.Context, unmappedArchs, mappedArchs, stdlibArchs, st
 	}
 	ua := &unmappedArchives{archs: unmappedArchs}
 
-	return New(ctxt, ua, ma, sa, stdlib), nil
+	i := newImporter(ctxt, entries, stdlib, opts...)
+	i.stdlib = sa
+	i.unmapped = ua
+	return i, nil
 }
 
 // New returns a new monorepo importer.
-func New(ctxt build.Context, ua *unmappedArchives, ma *mappedArchives, sa *stdlibArchives, stdlibZip *zip.Reader) *Importer {
+func New(ctxt build.Context, ua *unmappedArchives, ma *mappedArchives, sa *stdlibArchives, stdlibZip *zip.Reader, opts ...ImporterOption) *Importer {
+	var entries []manifestEntry
+	if ma != nil {
+		for importPath, archivePath := range ma.pkgs {
+			entries = append(entries, manifestEntry{
+				ImportPath:  importPath,
+				ArchivePath: archivePath,
+				Kind:        "dep",
+			})
+		}
+	}
+	i := newImporter(ctxt, entries, stdlibZip, opts...)
+	i.stdlib = sa
+	i.unmapped = ua
+	return i
+}
+
+// newImporter builds the common Importer state shared by every constructor:
+// the manifest-backed finder and, if present, the stdlib zip reader.
+func newImporter(ctxt build.Context, entries []manifestEntry, stdlibZip *zip.Reader, opts ...ImporterOption) *Importer {
 	i := &Importer{
 		imports: map[string]*types.Package{
 			"unsafe": types.Unsafe,
 		},
 		fset:     token.NewFileSet(),
-		mapped:   ma,
-		stdlib:   sa,
-		unmapped: ua,
+		manifest: newManifestFinder(ctxt, entries),
+		ctxt:     ctxt,
 	}
 	if stdlibZip != nil {
 		i.stdlibZip = newZipReader(stdlibZip, ctxt)
 	}
+	for _, opt := range opts {
+		opt(i)
+	}
 	return i
 }
 
-// Import implements types.Importer.Import.
+// NewFromManifest returns a new monorepo importer built entirely from a JSON
+// manifest at path, describing every dependency as a
+// {importPath, archivePath, kind, goos, goarch, cgo} object. This replaces
+// guessing an import path from an archive's file name or suffix: Bazel/Buck2
+// rules can emit such a manifest deterministically (similar to the aspect
+// rules_go uses for its go_path rule), and a single manifest can describe
+// multiple GOOS/GOARCH targets at once by tagging each entry.
+func NewFromManifest(ctxt build.Context, path string, opts ...ImporterOption) (*Importer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open manifest %q: %v", path, err)
+	}
+	defer f.Close()
+
+	var m manifest
+	if err := json.NewDecoder(f).Decode(&m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %q: %v", path, err)
+	}
+	return newImporter(ctxt, m.Packages, nil, opts...), nil
+}
+
+// NewFromGoPathZips returns a new monorepo importer that resolves packages
+// from one or more rules_go go_path zip archives, each containing a GOPATH
+// layout ("src/<importPath>/*.go" and, optionally, precompiled export data
+// under "pkg/<goos_goarch>/<importPath>.a"). This lets bb consume a single
+// go_path target's output instead of an archive path per go_library, which
+// is friendlier to CI pipelines that already produce such a zip.
+func NewFromGoPathZips(ctxt build.Context, zips []string, opts ...ImporterOption) (*Importer, error) {
+	g := newGoPathZip(ctxt)
+	for _, path := range zips {
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("could not open go_path zip %q: %v", path, err)
+		}
+		g.index(&zr.Reader)
+	}
+
+	i := newImporter(ctxt, nil, nil, opts...)
+	i.goPathZip = g
+	g.importer = i
+	return i, nil
+}
+
+// importCall deduplicates concurrent Import calls for the same import path:
+// the first caller does the work, everyone else waits on the same result.
+type importCall struct {
+	once sync.Once
+	pkg  *types.Package
+	err  error
+}
+
+// Import implements types.Importer.Import. It is safe for concurrent use by
+// multiple goroutines, e.g. callers type-checking several packages in
+// parallel via LoadMany.
 func (i *Importer) Import(importPath string) (*types.Package, error) {
+	return i.importVisiting(importPath, nil)
+}
+
+// importVisiting is Import, plus the set of import paths already being
+// resolved via source fallback earlier on this call chain. Recursive calls
+// made while resolving a package from source (see importFromSource) go
+// through this, not Import, so that a cycle reached purely through source
+// resolution -- A imports B imports A, neither with an archive -- is caught
+// by the visiting check below *before* we'd otherwise re-enter the same
+// importCall's sync.Once from the same goroutine and deadlock.
+func (i *Importer) importVisiting(importPath string, visiting map[string]bool) (*types.Package, error) {
+	if visiting[importPath] {
+		return nil, fmt.Errorf("import cycle while resolving %q from source", importPath)
+	}
+
+	i.mu.Lock()
 	if pkg, ok := i.imports[importPath]; ok && pkg.Complete() {
+		i.mu.Unlock()
 		return pkg, nil
 	}
+	if i.inflight == nil {
+		i.inflight = make(map[string]*importCall)
+	}
+	call, ok := i.inflight[importPath]
+	if !ok {
+		call = &importCall{}
+		i.inflight[importPath] = call
+	}
+	i.mu.Unlock()
+
+	call.once.Do(func() {
+		call.pkg, call.err = i.doImport(importPath, visiting)
+	})
+	return call.pkg, call.err
+}
 
+// doImport does the actual finder lookup and export data decoding for
+// importPath. It is only ever run once per import path, via the
+// sync.Once in importCall.
+func (i *Importer) doImport(importPath string, visiting map[string]bool) (*types.Package, error) {
 	var finders []finder
-	// stdlibZip and mapped do exact file matching based on
-	// importPath, they never return the wrong package.
+	// manifest and stdlibZip do exact file matching based on importPath,
+	// they never return the wrong package.
+	if i.manifest != nil {
+		finders = append(finders, i.manifest)
+	}
+	if i.goPathZip != nil {
+		finders = append(finders, i.goPathZip)
+	}
 	if i.stdlibZip != nil {
 		finders = append(finders, i.stdlibZip)
 	}
-	if i.mapped != nil {
-		finders = append(finders, i.mapped)
-	}
 	// stdlib and unmapped match based on file path suffix, so they
 	// may return the wrong package. Match to stdlib first, because
 	// stdlib contains shorter paths. (E.g. "errors" can match to
@@ -294,17 +881,193 @@ func (i *Importer) Import(importPath string) (*types.Package, error) {
 	}
 	file := find(finders, importPath)
 	if file == nil {
-		return nil, fmt.Errorf("package %q not found", importPath)
+		if len(i.sourceRoots) == 0 {
+			return nil, fmt.Errorf("package %q not found", importPath)
+		}
+		return i.importFromSource(importPath, visiting)
 	}
 	defer file.Close()
 
-	r, err := gcexportdata.NewReader(file)
+	if i.cache == nil {
+		if _, ok := file.(rawExportData); ok {
+			return i.readRawExportData(file, importPath)
+		}
+		return i.readExportData(file, importPath)
+	}
+	return i.doImportCached(importPath, file)
+}
+
+// doImportCached is doImport's path when a cache is configured: it hashes
+// the archive once while reading it, and replays a previously-stashed
+// export-data blob instead of re-decoding if the hash was already seen.
+func (i *Importer) doImportCached(importPath string, file io.ReadCloser) (*types.Package, error) {
+	_, isRaw := file.(rawExportData)
+
+	hash := sha256.New()
+	data, err := io.ReadAll(io.TeeReader(file, hash))
+	if err != nil {
+		return nil, err
+	}
+	key := cacheKey(importPath, hex.EncodeToString(hash.Sum(nil)), i.ctxt.GOOS, i.ctxt.GOARCH)
+
+	if blob, ok := i.cache.lookup(key); ok {
+		// Cache entries are always stored as gcexportdata.Write's
+		// output (see the store call below), regardless of whether
+		// importPath's original archive needed a header scan, so the
+		// cached blob is always decoded as raw export data.
+		if pkg, err := i.readRawExportData(bytes.NewReader(blob), importPath); err == nil {
+			return pkg, nil
+		}
+		log.Printf("export cache: stale entry for %q, recomputing", importPath)
+	}
+
+	decode := i.readExportData
+	if isRaw {
+		decode = i.readRawExportData
+	}
+	pkg, err := decode(bytes.NewReader(data), importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	i.mu.Lock()
+	err = gcexportdata.Write(&buf, i.fset, pkg)
+	i.mu.Unlock()
+	if err != nil {
+		log.Printf("export cache: could not serialize %q, not caching: %v", importPath, err)
+		return pkg, nil
+	}
+	i.cache.store(key, buf.Bytes())
+	return pkg, nil
+}
+
+// readExportData decodes a real compiler archive's export data for
+// importPath from r into i.imports, first locating the export data section
+// via gcexportdata.NewReader.
+func (i *Importer) readExportData(r io.Reader, importPath string) (*types.Package, error) {
+	gcr, err := gcexportdata.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return gcexportdata.Read(gcr, i.fset, i.imports, importPath)
+}
+
+// readRawExportData decodes export data for importPath from r into
+// i.imports, where r is already gcexportdata.Write's output (see
+// rawExportData) rather than a real compiler archive, so no
+// gcexportdata.NewReader header scan is needed or possible.
+func (i *Importer) readRawExportData(r io.Reader, importPath string) (*types.Package, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
 	return gcexportdata.Read(r, i.fset, i.imports, importPath)
 }
 
+// sourceVisitingImporter is the types.Importer handed to the type-checker
+// while resolving a package from source. It routes back through
+// importVisiting with an extended visiting set, so a cycle among
+// source-resolved packages is reported instead of deadlocking.
+type sourceVisitingImporter struct {
+	i        *Importer
+	visiting map[string]bool
+}
+
+func (s sourceVisitingImporter) Import(importPath string) (*types.Package, error) {
+	return s.i.importVisiting(importPath, s.visiting)
+}
+
+// importFromSource resolves importPath by locating its package directory
+// under i.sourceRoots, parsing its Go files, and type-checking them
+// recursively (so their own imports go through the usual finders, and
+// through source fallback again if needed). The result is cached in
+// i.imports just as if it had come from export data.
+//
+// visiting is the set of import paths already being resolved from source
+// earlier on this call chain; importPath is added to it before recursing,
+// so a cycle reported back to us as "importPath" is caught immediately by
+// importVisiting rather than recursing forever.
+func (i *Importer) importFromSource(importPath string, visiting map[string]bool) (*types.Package, error) {
+	childVisiting := make(map[string]bool, len(visiting)+1)
+	for p := range visiting {
+		childVisiting[p] = true
+	}
+	childVisiting[importPath] = true
+
+	dir, err := i.findSourceDir(importPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not read %q: %v", dir, err)
+	}
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		// MatchFile applies the Importer's GOOS/GOARCH/cgo settings and
+		// build constraints, so files excluded from a real compile
+		// (e.g. cgo-only or other-GOOS files) are excluded here too.
+		match, err := i.ctxt.MatchFile(dir, name)
+		if err != nil || !match {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no buildable Go files for %q in %q", importPath, dir)
+	}
+
+	var astFiles []*ast.File
+	for _, f := range files {
+		src, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		astFile, err := parser.ParseFile(i.fset, f, src, 0)
+		if err != nil {
+			return nil, err
+		}
+		astFiles = append(astFiles, astFile)
+	}
+
+	conf := types.Config{
+		Importer:         sourceVisitingImporter{i: i, visiting: childVisiting},
+		IgnoreFuncBodies: true,
+	}
+	tpkg, err := conf.Check(importPath, i.fset, astFiles, nil)
+	if err != nil {
+		return nil, fmt.Errorf("type checking %q from source failed: %v", importPath, err)
+	}
+
+	i.mu.Lock()
+	i.imports[importPath] = tpkg
+	i.mu.Unlock()
+	return tpkg, nil
+}
+
+// findSourceDir looks for importPath's package directory among
+// i.sourceRoots, trying both a GOPATH-style layout (root/src/<importPath>)
+// and a module-cache-style layout (root/<importPath>).
+func (i *Importer) findSourceDir(importPath string) (string, error) {
+	for _, root := range i.sourceRoots {
+		for _, dir := range []string{
+			filepath.Join(root, "src", importPath),
+			filepath.Join(root, importPath),
+		} {
+			if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+				return dir, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("package %q not found in any source root", importPath)
+}
+
 // Load loads a google3 package.
 func Load(pkgPath string, filepaths []string, importer types.Importer) (*packages.Package, error) {
 	p := &packages.Package{
@@ -346,3 +1109,253 @@ func Load(pkgPath string, filepaths []string, importer types.Importer) (*package
 	p.Types = tpkg
 	return p, nil
 }
+
+// LoadRequest describes a single package to load as part of a LoadMany call.
+type LoadRequest struct {
+	// PkgPath is the package's import path.
+	PkgPath string
+
+	// Files is the list of Go source file paths belonging to the package.
+	Files []string
+}
+
+// parsedLoadRequest is the result of parsing a LoadRequest's files, before
+// type-checking.
+type parsedLoadRequest struct {
+	req             LoadRequest
+	fset            *token.FileSet
+	syntax          []*ast.File
+	parsedFileNames []string
+
+	// imports is the set of import paths found in syntax, used to derive
+	// a dependency order among the requests passed to LoadMany.
+	imports map[string]bool
+}
+
+// localImporter resolves import paths among the packages being loaded by a
+// single LoadMany call before falling back to the underlying importer. This
+// lets LoadMany's batch of packages import each other without having to
+// have been compiled to on-disk archives first.
+type localImporter struct {
+	underlying types.Importer
+
+	mu     sync.Mutex
+	byPath map[string]*types.Package
+}
+
+func (l *localImporter) Import(importPath string) (*types.Package, error) {
+	l.mu.Lock()
+	pkg, ok := l.byPath[importPath]
+	l.mu.Unlock()
+	if ok {
+		return pkg, nil
+	}
+	return l.underlying.Import(importPath)
+}
+
+func (l *localImporter) add(importPath string, pkg *types.Package) {
+	l.mu.Lock()
+	l.byPath[importPath] = pkg
+	l.mu.Unlock()
+}
+
+// LoadMany parses and type-checks many packages at once. Files belonging to
+// each LoadRequest are parsed in parallel using a worker pool; packages are
+// then type-checked in the dependency order derived from their import
+// statements, so that if one of pkgs imports another, the dependency is
+// type-checked first. Independent packages -- the common case for bb, where
+// each command's main package stands alone -- are type-checked concurrently.
+//
+// importer is used to resolve imports that aren't among pkgs themselves,
+// e.g. the standard library or other monorepo dependencies; it must be safe
+// for concurrent use (as *Importer is).
+func LoadMany(pkgs []LoadRequest, importer types.Importer) ([]*packages.Package, error) {
+	n := len(pkgs)
+	if n == 0 {
+		return nil, nil
+	}
+
+	parsed := make([]parsedLoadRequest, n)
+	{
+		var wg sync.WaitGroup
+		errs := make([]error, n)
+		// A worker per request is fine here: parsing is I/O- and
+		// CPU-bound, not goroutine-creation-bound, and n is at most a
+		// few hundred bb commands.
+		for idx, req := range pkgs {
+			wg.Add(1)
+			go func(idx int, req LoadRequest) {
+				defer wg.Done()
+				fset, astFiles, parsedFileNames, err := bbinternal.ParseAST("main", req.Files)
+				if err != nil {
+					errs[idx] = fmt.Errorf("parsing %q: %v", req.PkgPath, err)
+					return
+				}
+				imports := make(map[string]bool)
+				for _, f := range astFiles {
+					for _, imp := range f.Imports {
+						path, err := strconv.Unquote(imp.Path.Value)
+						if err != nil {
+							continue
+						}
+						imports[path] = true
+					}
+				}
+				parsed[idx] = parsedLoadRequest{
+					req:             req,
+					fset:            fset,
+					syntax:          astFiles,
+					parsedFileNames: parsedFileNames,
+					imports:         imports,
+				}
+			}(idx, req)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Build a dependency graph restricted to pkgs: edge j -> idx means
+	// idx imports the package at index j, so j must be type-checked
+	// first.
+	indexOf := make(map[string]int, n)
+	for idx, req := range pkgs {
+		indexOf[req.PkgPath] = idx
+	}
+	dependents := make([][]int, n)
+	indegree := make([]int, n)
+	for idx, p := range parsed {
+		for imp := range p.imports {
+			if j, ok := indexOf[imp]; ok && j != idx {
+				dependents[j] = append(dependents[j], idx)
+				indegree[idx]++
+			}
+		}
+	}
+	if cyclic, ok := findCycle(pkgs, dependents, indegree); !ok {
+		return nil, fmt.Errorf("import cycle among requested packages, including %q", pkgs[cyclic].PkgPath)
+	}
+
+	local := &localImporter{underlying: importer, byPath: make(map[string]*types.Package)}
+	out := make([]*packages.Package, n)
+
+	ready := make(chan int, n)
+	done := make(chan int, n)
+	errCh := make(chan error, n)
+	for idx, deg := range indegree {
+		if deg == 0 {
+			ready <- idx
+		}
+	}
+
+	for remaining := n; remaining > 0; {
+		select {
+		case idx := <-ready:
+			go func(idx int) {
+				p, tpkg, err := typeCheckOne(parsed[idx], local)
+				if err != nil {
+					errCh <- fmt.Errorf("type checking %q: %v", pkgs[idx].PkgPath, err)
+					return
+				}
+				local.add(pkgs[idx].PkgPath, tpkg)
+				out[idx] = p
+				done <- idx
+			}(idx)
+		case idx := <-done:
+			remaining--
+			for _, dependent := range dependents[idx] {
+				indegree[dependent]--
+				if indegree[dependent] == 0 {
+					ready <- dependent
+				}
+			}
+		case err := <-errCh:
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// findCycle runs Kahn's algorithm over a copy of indegree to check whether
+// dependents/indegree describe a DAG. It returns (0, true) if so, or the
+// index of a package stuck in a cycle and false otherwise.
+func findCycle(pkgs []LoadRequest, dependents [][]int, indegree []int) (int, bool) {
+	indegree = append([]int(nil), indegree...)
+	var queue []int
+	for idx, deg := range indegree {
+		if deg == 0 {
+			queue = append(queue, idx)
+		}
+	}
+	visited := 0
+	for len(queue) > 0 {
+		idx := queue[0]
+		queue = queue[1:]
+		visited++
+		for _, dependent := range dependents[idx] {
+			indegree[dependent]--
+			if indegree[dependent] == 0 {
+				queue = append(queue, dependent)
+			}
+		}
+	}
+	if visited == len(pkgs) {
+		return 0, true
+	}
+	// Every package left with a positive indegree has a dependency that
+	// is left over too, so walking back through such dependencies
+	// len(pkgs) times from any of them ends on a package in a cycle.
+	cur := -1
+	for idx, deg := range indegree {
+		if deg > 0 {
+			cur = idx
+			break
+		}
+	}
+	for step := 0; step < len(pkgs); step++ {
+	next:
+		for j, deps := range dependents {
+			if indegree[j] == 0 {
+				continue
+			}
+			for _, d := range deps {
+				if d == cur {
+					cur = j
+					break next
+				}
+			}
+		}
+	}
+	return cur, false
+}
+
+// typeCheckOne type-checks a single already-parsed package, resolving
+// imports among the LoadMany batch via local before falling back to
+// local.underlying.
+func typeCheckOne(p parsedLoadRequest, local *localImporter) (*packages.Package, *types.Package, error) {
+	pkg := &packages.Package{
+		PkgPath:         p.req.PkgPath,
+		Fset:            p.fset,
+		Syntax:          p.syntax,
+		CompiledGoFiles: p.parsedFileNames,
+		GoFiles:         p.req.Files,
+	}
+
+	conf := types.Config{
+		Importer:         local,
+		IgnoreFuncBodies: true,
+	}
+	pkg.TypesInfo = &types.Info{
+		Types:  make(map[ast.Expr]types.TypeAndValue),
+		Scopes: make(map[ast.Node]*types.Scope),
+	}
+	tpkg, err := conf.Check(p.req.PkgPath, pkg.Fset, pkg.Syntax, pkg.TypesInfo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("type checking failed: %v", err)
+	}
+	pkg.Types = tpkg
+	return pkg, tpkg, nil
+}
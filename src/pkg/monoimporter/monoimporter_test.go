@@ -0,0 +1,338 @@
+package monoimporter
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"go/build"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func boolPtr(b bool) *bool { return &b }
+
+func TestNewManifestFinderCgoFilter(t *testing.T) {
+	ctxt := build.Context{GOOS: "linux", GOARCH: "amd64", CgoEnabled: true}
+
+	entries := []manifestEntry{
+		// Synthesized "dep" entries (e.g. from NewFromZips/New) never set
+		// Cgo, so they must match regardless of ctxt.CgoEnabled.
+		{ImportPath: "example.com/unset", ArchivePath: "/unset.a"},
+		{ImportPath: "example.com/cgo-match", ArchivePath: "/cgo-match.a", Cgo: boolPtr(true)},
+		{ImportPath: "example.com/cgo-mismatch", ArchivePath: "/cgo-mismatch.a", Cgo: boolPtr(false)},
+		{ImportPath: "example.com/goarch-mismatch", ArchivePath: "/goarch.a", GOARCH: "arm64"},
+	}
+
+	f := newManifestFinder(ctxt, entries)
+
+	if _, ok := f.pkgs["example.com/unset"]; !ok {
+		t.Error("entry with unset Cgo was dropped, want it to match any CgoEnabled setting")
+	}
+	if _, ok := f.pkgs["example.com/cgo-match"]; !ok {
+		t.Error("entry with Cgo=true was dropped when ctxt.CgoEnabled=true")
+	}
+	if _, ok := f.pkgs["example.com/cgo-mismatch"]; ok {
+		t.Error("entry with Cgo=false should not match ctxt.CgoEnabled=true")
+	}
+	if _, ok := f.pkgs["example.com/goarch-mismatch"]; ok {
+		t.Error("entry for a different GOARCH should not match")
+	}
+}
+
+func TestNewManifestFinderWarnsOnUnrecognizedKind(t *testing.T) {
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	entries := []manifestEntry{
+		{ImportPath: "example.com/good", ArchivePath: "/good.a", Kind: "dep"},
+		{ImportPath: "example.com/typo", ArchivePath: "/typo.a", Kind: "dpe"},
+	}
+	f := newManifestFinder(build.Default, entries)
+
+	// An unrecognized kind is a manifest-authoring bug worth surfacing,
+	// but the entry still matches by ImportPath -- kind is advisory, not
+	// load-bearing for the exact-match manifestFinder.
+	if _, ok := f.pkgs["example.com/typo"]; !ok {
+		t.Error("entry with an unrecognized kind should still be matched by ImportPath")
+	}
+	if !strings.Contains(logs.String(), `"dpe"`) {
+		t.Errorf("want a warning naming the bad kind, got log: %s", logs.String())
+	}
+}
+
+func TestGoPathZipSourceFallback(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, err := zw.Create("src/example.com/examplepkg/examplepkg.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("package examplepkg\n\nconst Answer = 42\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctxt := build.Default
+	g := newGoPathZip(ctxt)
+	g.index(zr)
+
+	i := newImporter(ctxt, nil, nil)
+	i.goPathZip = g
+	g.importer = i
+
+	pkg, err := i.Import("example.com/examplepkg")
+	if err != nil {
+		t.Fatalf("Import: %v", err)
+	}
+	if !pkg.Complete() {
+		t.Fatal("package compiled from source is not Complete")
+	}
+	if pkg.Scope().Lookup("Answer") == nil {
+		t.Fatal("want Answer declared in the package compiled from source")
+	}
+}
+
+func TestFindCycle(t *testing.T) {
+	pkgs := []LoadRequest{{PkgPath: "a"}, {PkgPath: "b"}, {PkgPath: "c"}}
+
+	// a -> b -> c is a valid dependency order (b depends on a, c on b).
+	if _, ok := findCycle(pkgs, [][]int{{1}, {2}, nil}, []int{0, 1, 1}); !ok {
+		t.Error("valid DAG was reported as having a cycle")
+	}
+
+	// a -> b -> c -> a is a genuine cycle.
+	idx, ok := findCycle(pkgs, [][]int{{1}, {2}, {0}}, []int{1, 1, 1})
+	if ok {
+		t.Error("cycle a->b->c->a was not detected")
+	}
+	if idx < 0 || idx >= len(pkgs) {
+		t.Errorf("findCycle returned out-of-range index %d", idx)
+	}
+}
+
+type importerFunc func(string) (*types.Package, error)
+
+func (f importerFunc) Import(path string) (*types.Package, error) { return f(path) }
+
+func TestLocalImporterPrefersBatchResults(t *testing.T) {
+	underlying := importerFunc(func(path string) (*types.Package, error) {
+		if path == "fallback" {
+			return types.NewPackage(path, path), nil
+		}
+		return nil, fmt.Errorf("not found: %s", path)
+	})
+	local := &localImporter{underlying: underlying, byPath: make(map[string]*types.Package)}
+
+	want := types.NewPackage("batchpkg", "batchpkg")
+	local.add("batchpkg", want)
+
+	if got, err := local.Import("batchpkg"); err != nil || got != want {
+		t.Errorf("Import(%q) = %v, %v; want the batch-local package", "batchpkg", got, err)
+	}
+	if got, err := local.Import("fallback"); err != nil || got.Path() != "fallback" {
+		t.Errorf("Import(%q) = %v, %v; want it to fall back to underlying", "fallback", got, err)
+	}
+	if _, err := local.Import("missing"); err == nil {
+		t.Error("want an error for an import neither batch-local nor resolvable by underlying")
+	}
+}
+
+func TestExportCacheRoundTripAndEviction(t *testing.T) {
+	c, err := newExportCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.maxEntries = 2
+
+	c.store("key1", []byte("blob1"))
+	c.store("key2", []byte("blob2"))
+
+	if data, ok := c.lookup("key1"); !ok || string(data) != "blob1" {
+		t.Fatalf("lookup(key1) = %q, %v; want \"blob1\", true", data, ok)
+	}
+
+	// key1 was just touched by the lookup above, making key2 the
+	// least-recently-used entry; storing a third should evict it.
+	c.store("key3", []byte("blob3"))
+
+	if _, ok := c.lookup("key2"); ok {
+		t.Error("key2 should have been evicted as the least-recently-used entry")
+	}
+	if _, ok := c.lookup("key1"); !ok {
+		t.Error("key1 should still be cached")
+	}
+	if data, ok := c.lookup("key3"); !ok || string(data) != "blob3" {
+		t.Errorf("lookup(key3) = %q, %v; want \"blob3\", true", data, ok)
+	}
+}
+
+// TestExportCacheServesDecodedResult imports the same source-compiled
+// package through doImportCached twice, via two separate Importers sharing a
+// cache dir (simulating two bb invocations), and checks that the second
+// import declares Answer without logging a "stale entry", i.e. without a
+// stashed blob failing to decode and being recomputed. A cache miss on the
+// second import is not detected here. exportCache's own round-trip test only
+// covers raw byte storage, not decoding a stashed blob back into a
+// *types.Package.
+func TestExportCacheServesDecodedResult(t *testing.T) {
+	var zipBuf bytes.Buffer
+	zw := zip.NewWriter(&zipBuf)
+	f, err := zw.Create("src/example.com/cachedpkg/cachedpkg.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("package cachedpkg\n\nconst Answer = 42\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zipBytes := zipBuf.Bytes()
+
+	ctxt := build.Default
+	cacheDir := t.TempDir()
+
+	importOnce := func() *types.Package {
+		zr, err := zip.NewReader(bytes.NewReader(zipBytes), int64(len(zipBytes)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := newGoPathZip(ctxt)
+		g.index(zr)
+
+		i := newImporter(ctxt, nil, nil, WithCacheDir(cacheDir))
+		i.goPathZip = g
+		g.importer = i
+
+		pkg, err := i.Import("example.com/cachedpkg")
+		if err != nil {
+			t.Fatalf("Import: %v", err)
+		}
+		return pkg
+	}
+
+	if pkg := importOnce(); pkg.Scope().Lookup("Answer") == nil {
+		t.Fatal("want Answer declared in the first, store-populating import")
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	pkg := importOnce()
+	if pkg.Scope().Lookup("Answer") == nil {
+		t.Fatal("want Answer declared in the second, cache-served import")
+	}
+	if strings.Contains(logs.String(), "stale entry") {
+		t.Errorf("second import recomputed instead of being served from the cache; log: %s", logs.String())
+	}
+}
+
+type erroringImporter struct{}
+
+func (erroringImporter) Import(path string) (*types.Package, error) {
+	return nil, fmt.Errorf("unexpected import of %q outside the batch", path)
+}
+
+func TestLoadMany(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name, src string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	aFile := writeFile("pkga.go", `package pkga
+
+const Answer = 41
+`)
+	bFile := writeFile("pkgb.go", `package pkgb
+
+import "example.com/pkga"
+
+const Answer = pkga.Answer + 1
+`)
+
+	// pkgb comes first in the request slice, but it depends on pkga, so
+	// LoadMany must type-check pkga first regardless of request order.
+	pkgs := []LoadRequest{
+		{PkgPath: "example.com/pkgb", Files: []string{bFile}},
+		{PkgPath: "example.com/pkga", Files: []string{aFile}},
+	}
+
+	out, err := LoadMany(pkgs, erroringImporter{})
+	if err != nil {
+		t.Fatalf("LoadMany: %v", err)
+	}
+	if len(out) != len(pkgs) {
+		t.Fatalf("got %d packages, want %d", len(out), len(pkgs))
+	}
+
+	b := out[0].Types.Scope().Lookup("Answer")
+	if b == nil {
+		t.Fatal("want Answer declared in pkgb")
+	}
+	bConst, ok := b.(*types.Const)
+	if !ok {
+		t.Fatalf("pkgb.Answer is a %T, want *types.Const", b)
+	}
+	if want := constant.MakeInt64(42); constant.Compare(bConst.Val(), token.NEQ, want) {
+		t.Errorf("pkgb.Answer = %v, want 42 (pkga.Answer + 1, proving pkga was resolved via the batch)", bConst.Val())
+	}
+}
+
+func TestSourceFallbackImportCycleErrors(t *testing.T) {
+	root := t.TempDir()
+	writePkg := func(importPath, src string) {
+		dir := filepath.Join(root, "src", importPath)
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(importPath)
+		if err := os.WriteFile(filepath.Join(dir, name+".go"), []byte(src), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writePkg("example.com/pkga", `package pkga
+
+import _ "example.com/pkgb"
+`)
+	writePkg("example.com/pkgb", `package pkgb
+
+import _ "example.com/pkga"
+`)
+
+	i := newImporter(build.Default, nil, nil, WithSourceFallback(root))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := i.Import("example.com/pkga")
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("want an error for a mutual import cycle resolved via source fallback, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Import deadlocked on a mutual import cycle instead of returning an error")
+	}
+}